@@ -47,6 +47,12 @@ type InvalidWorkerOfferingSpecInput struct {
 	// If not specified, and the e2econfig variable IPFamily is IPV6, then "ipv6" is used,
 	// otherwise the default flavor is used.
 	Flavor *string
+
+	// PostNamespaceCreated is a hook called right after the spec namespace is created, giving
+	// the caller a chance to inject CloudStack-specific prerequisites (e.g. CloudStackFailureDomain,
+	// CloudStackAffinityGroup, credential Secrets, or ClusterResourceSet bindings) before the rest
+	// of the spec runs.
+	PostNamespaceCreated func(managementClusterProxy framework.ClusterProxy, workloadClusterNamespace string)
 }
 
 // InvalidWorkerOfferingSpec implements a test that verifies that creating a new cluster fails when the specified worker offering does not exist
@@ -71,6 +77,9 @@ func InvalidWorkerOfferingSpec(ctx context.Context, inputGetter func() InvalidWo
 
 		// Setup a Namespace where to host objects for this spec and create a watcher for the namespace events.
 		namespace, cancelWatches = setupSpecNamespace(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder)
+		if input.PostNamespaceCreated != nil {
+			input.PostNamespaceCreated(input.BootstrapClusterProxy, namespace.Name)
+		}
 		clusterResources = new(clusterctl.ApplyClusterTemplateAndWaitResult)
 	})
 
@@ -106,6 +115,10 @@ func InvalidWorkerOfferingSpec(ctx context.Context, inputGetter func() InvalidWo
 			Namespace: namespace.Name,
 		})
 
+		// NOTE: this still scrapes manager.log rather than asserting on a structured condition,
+		// because the CloudStackMachine controller doesn't yet set one when an offering lookup
+		// comes back empty. Replacing this requires a controller-side change that is out of scope
+		// for this tree.
 		By("Waiting for 'offering not found' error to occur")
 		Eventually(func() (string, error) {
 			err := filepath.Walk(logFolder, func(path string, info os.FileInfo, err error) error {
@@ -135,4 +148,4 @@ func InvalidWorkerOfferingSpec(ctx context.Context, inputGetter func() InvalidWo
 		// Dumps all the resources in the spec namespace, then cleanups the cluster object and the spec namespace itself.
 		dumpSpecResourcesAndCleanup(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder, namespace, cancelWatches, clusterResources.Cluster, input.E2EConfig.GetIntervals, input.SkipCleanup)
 	})
-}
\ No newline at end of file
+}
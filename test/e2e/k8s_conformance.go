@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/pointer"
+
+	"sigs.k8s.io/cluster-api/test/framework"
+	"sigs.k8s.io/cluster-api/test/framework/clusterctl"
+	"sigs.k8s.io/cluster-api/util"
+)
+
+// KubetestConfiguration is the config file path passed by the KUBETEST_CONFIGURATION e2e config variable.
+const KubetestConfiguration = "KUBETEST_CONFIGURATION"
+
+// K8SConformanceSpecInput is the input for K8SConformanceSpec.
+type K8SConformanceSpecInput struct {
+	E2EConfig             *clusterctl.E2EConfig
+	ClusterctlConfigPath  string
+	BootstrapClusterProxy framework.ClusterProxy
+	ArtifactFolder        string
+	SkipCleanup           bool
+
+	// Flavor, if specified is the template flavor used to create the cluster for testing.
+	// If not specified, the "conformance" flavor is used.
+	Flavor *string
+
+	// KubetestConfigFilePath is the path to a kubetest configuration file, e.g. conformance.yaml
+	// or conformance-fast.yaml, describing ginkgo.focus, ginkgo.skip, parallel and numberOfNodes.
+	KubetestConfigFilePath string
+
+	// PostNamespaceCreated is a hook called right after the spec namespace is created, giving
+	// the caller a chance to inject CloudStack-specific prerequisites (e.g. CloudStackFailureDomain,
+	// CloudStackAffinityGroup, credential Secrets, or ClusterResourceSet bindings) before the rest
+	// of the spec runs.
+	PostNamespaceCreated func(managementClusterProxy framework.ClusterProxy, workloadClusterNamespace string)
+}
+
+// K8SConformanceSpec implements a test that provisions a workload cluster and runs the upstream
+// Kubernetes conformance suite against it via kubetest.
+func K8SConformanceSpec(ctx context.Context, inputGetter func() K8SConformanceSpecInput) {
+	var (
+		specName         = "k8s-conformance"
+		input            K8SConformanceSpecInput
+		namespace        *corev1.Namespace
+		cancelWatches    context.CancelFunc
+		clusterResources *clusterctl.ApplyClusterTemplateAndWaitResult
+	)
+
+	BeforeEach(func() {
+		Expect(ctx).NotTo(BeNil(), "ctx is required for %s spec", specName)
+		input = inputGetter()
+		Expect(input.E2EConfig).ToNot(BeNil(), "Invalid argument. input.E2EConfig can't be nil when calling %s spec", specName)
+		Expect(input.ClusterctlConfigPath).To(BeAnExistingFile(), "Invalid argument. input.ClusterctlConfigPath must be an existing file when calling %s spec", specName)
+		Expect(input.BootstrapClusterProxy).ToNot(BeNil(), "Invalid argument. input.BootstrapClusterProxy can't be nil when calling %s spec", specName)
+		Expect(os.MkdirAll(input.ArtifactFolder, 0750)).To(Succeed(), "Invalid argument. input.ArtifactFolder can't be created for %s spec", specName)
+
+		Expect(input.E2EConfig.Variables).To(HaveKey(KubernetesVersion))
+
+		// If the caller didn't set KubetestConfigFilePath directly, fall back to the
+		// KUBETEST_CONFIGURATION e2e config variable.
+		if input.KubetestConfigFilePath == "" && input.E2EConfig.HasVariable(KubetestConfiguration) {
+			input.KubetestConfigFilePath = input.E2EConfig.GetVariable(KubetestConfiguration)
+		}
+		Expect(input.KubetestConfigFilePath).To(BeAnExistingFile(), "Invalid argument. input.KubetestConfigFilePath must be an existing file when calling %s spec", specName)
+
+		// Setup a Namespace where to host objects for this spec and create a watcher for the namespace events.
+		namespace, cancelWatches = setupSpecNamespace(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder)
+		if input.PostNamespaceCreated != nil {
+			input.PostNamespaceCreated(input.BootstrapClusterProxy, namespace.Name)
+		}
+		clusterResources = new(clusterctl.ApplyClusterTemplateAndWaitResult)
+	})
+
+	// This spec is tagged [conformance] so `make test-conformance` can select it by name; the
+	// ginkgo.v1 API this package uses has no Label decorator to do this instead.
+	It("Should create a workload cluster and pass the upstream conformance suite [conformance]", func() {
+		logFolder := filepath.Join(input.ArtifactFolder, "clusters", input.BootstrapClusterProxy.GetName())
+		clusterName := fmt.Sprintf("%s-%s", specName, util.RandomString(6))
+
+		By("Creating a workload cluster")
+		clusterctl.ApplyClusterTemplateAndWait(ctx, clusterctl.ApplyClusterTemplateAndWaitInput{
+			ClusterProxy: input.BootstrapClusterProxy,
+			ConfigCluster: clusterctl.ConfigClusterInput{
+				KubeconfigPath:           input.BootstrapClusterProxy.GetKubeconfigPath(),
+				ClusterctlConfigPath:     input.ClusterctlConfigPath,
+				Flavor:                   pointer.StringPtrDerefOr(input.Flavor, "conformance"),
+				Namespace:                namespace.Name,
+				ClusterName:              clusterName,
+				KubernetesVersion:        input.E2EConfig.GetVariable(KubernetesVersion),
+				ControlPlaneMachineCount: pointer.Int64Ptr(1),
+				WorkerMachineCount:       pointer.Int64Ptr(2),
+				InfrastructureProvider:   clusterctl.DefaultInfrastructureProvider,
+				LogFolder:                logFolder,
+			},
+			WaitForClusterIntervals:      input.E2EConfig.GetIntervals(specName, "wait-cluster"),
+			WaitForControlPlaneIntervals: input.E2EConfig.GetIntervals(specName, "wait-control-plane"),
+			WaitForMachineDeployments:    input.E2EConfig.GetIntervals(specName, "wait-worker-nodes"),
+		}, clusterResources)
+
+		By("Running the Kubernetes conformance suite against the workload cluster")
+		workloadKubeconfigPath := input.BootstrapClusterProxy.GetWorkloadCluster(ctx, namespace.Name, clusterName).GetKubeconfigPath()
+		kubernetesVersion := input.E2EConfig.GetVariable(KubernetesVersion)
+
+		testArgs, err := buildKubetestArgs(input.KubetestConfigFilePath, kubernetesVersion)
+		Expect(err).ToNot(HaveOccurred(), "Failed to build kubetest args from %s", input.KubetestConfigFilePath)
+
+		conformanceLogPath := filepath.Join(logFolder, "kubetest.log")
+		logFile, err := os.Create(conformanceLogPath)
+		Expect(err).ToNot(HaveOccurred(), "Failed to create kubetest log file %s", conformanceLogPath)
+		defer logFile.Close()
+
+		cmd := exec.CommandContext(ctx, "kubetest", //nolint:gosec
+			"--provider=skeleton",
+			"--test",
+			fmt.Sprintf("--test_args=%s", testArgs),
+			fmt.Sprintf("--kubeconfig=%s", workloadKubeconfigPath),
+			fmt.Sprintf("--extract=%s", kubernetesVersion),
+		)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+
+		By("Streaming kubetest output to " + conformanceLogPath)
+		Expect(cmd.Run()).To(Succeed(), "Conformance suite failed, see %s for details", conformanceLogPath)
+
+		By("PASSED!")
+	})
+
+	AfterEach(func() {
+		// Dumps all the resources in the spec namespace, then cleanups the cluster object and the spec namespace itself.
+		dumpSpecResourcesAndCleanup(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder, namespace, cancelWatches, clusterResources.Cluster, input.E2EConfig.GetIntervals, input.SkipCleanup)
+	})
+}
+
+// buildKubetestArgs renders the ginkgo.focus, ginkgo.skip, parallel and numberOfNodes settings from
+// the kubetest configuration file (e.g. conformance.yaml / conformance-fast.yaml) into a kubetest
+// --test_args string.
+func buildKubetestArgs(kubetestConfigFilePath string, kubernetesVersion string) (string, error) {
+	cfg, err := loadKubetestConfig(kubetestConfigFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	args := fmt.Sprintf("--ginkgo.focus=%s --ginkgo.skip=%s --num-nodes=%d",
+		cfg.GinkgoFocus, cfg.GinkgoSkip, cfg.NumberOfNodes)
+	if cfg.Parallel {
+		args += " --ginkgo.parallel"
+	}
+	return args, nil
+}
+
+// kubetestConfig mirrors the fields capc reads out of a kubetest configuration file such as
+// conformance.yaml or conformance-fast.yaml.
+type kubetestConfig struct {
+	GinkgoFocus   string `json:"ginkgo.focus"`
+	GinkgoSkip    string `json:"ginkgo.skip"`
+	Parallel      bool   `json:"parallel"`
+	NumberOfNodes int    `json:"numberOfNodes"`
+}
+
+func loadKubetestConfig(kubetestConfigFilePath string) (*kubetestConfig, error) {
+	data, err := os.ReadFile(kubetestConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubetest config %s: %w", kubetestConfigFilePath, err)
+	}
+	cfg := &kubetestConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse kubetest config %s: %w", kubetestConfigFilePath, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sigs.k8s.io/cluster-api/test/framework"
+	"sigs.k8s.io/cluster-api/test/framework/clusterctl"
+	"sigs.k8s.io/cluster-api/util"
+)
+
+// Environment variables read by ScaleSpec to size the stress test.
+const (
+	ScaleClusterCountVar      = "CAPC_SCALE_CLUSTER_COUNT"
+	ScaleConcurrencyVar       = "CAPC_SCALE_CONCURRENCY"
+	ScaleControlPlaneCountVar = "CAPC_SCALE_CONTROL_PLANE_COUNT"
+	ScaleWorkerCountVar       = "CAPC_SCALE_WORKER_COUNT"
+)
+
+// ScaleSpecInput is the input for ScaleSpec.
+type ScaleSpecInput struct {
+	E2EConfig             *clusterctl.E2EConfig
+	ClusterctlConfigPath  string
+	BootstrapClusterProxy framework.ClusterProxy
+	ArtifactFolder        string
+	SkipCleanup           bool
+
+	// Flavor, if specified is the template flavor used to create the clusters for testing.
+	Flavor *string
+
+	// ClusterCount is the number of workload clusters to create. Defaults to the
+	// CAPC_SCALE_CLUSTER_COUNT env var, or 10 if unset.
+	ClusterCount int
+
+	// Concurrency is the number of clusters created/deleted in parallel. Defaults to the
+	// CAPC_SCALE_CONCURRENCY env var, or 5 if unset.
+	Concurrency int
+
+	// ControlPlaneMachineCount is the number of control plane machines per cluster. Defaults to
+	// the CAPC_SCALE_CONTROL_PLANE_COUNT env var, or 1 if unset.
+	ControlPlaneMachineCount int64
+
+	// WorkerMachineCount is the number of worker machines per cluster. Defaults to the
+	// CAPC_SCALE_WORKER_COUNT env var, or 1 if unset.
+	WorkerMachineCount int64
+
+	// DeployClusterInSeparateNamespaces creates each workload cluster in its own namespace
+	// instead of sharing a single spec namespace.
+	DeployClusterInSeparateNamespaces bool
+
+	// PostNamespaceCreated is a hook called right after each spec namespace is created, giving
+	// the caller a chance to inject CloudStack-specific prerequisites (e.g. CloudStackFailureDomain,
+	// CloudStackAffinityGroup, credential Secrets, or ClusterResourceSet bindings) before clusters
+	// are created in it. If DeployClusterInSeparateNamespaces is set, this is called once per
+	// per-cluster namespace; otherwise it is called once for the shared spec namespace.
+	PostNamespaceCreated func(managementClusterProxy framework.ClusterProxy, workloadClusterNamespace string)
+
+	// AssertResourcesCleanedUp, if set, is called once for every spec namespace after all clusters
+	// have been deleted, to assert that CloudStack-side resources (networks, isolated networks,
+	// affinity groups, ...) provisioned on behalf of that namespace were cleaned up. This package
+	// has no CloudStack client of its own, so CloudStack-specific assertions are supplied by the
+	// caller via this hook rather than being hardcoded here.
+	AssertResourcesCleanedUp func(managementClusterProxy framework.ClusterProxy, workloadClusterNamespace string)
+}
+
+// clusterTiming records the create/ready/delete latencies observed for a single workload cluster.
+type clusterTiming struct {
+	ClusterName   string        `json:"clusterName"`
+	Namespace     string        `json:"namespace"`
+	CreateSeconds float64       `json:"createSeconds"`
+	ReadySeconds  float64       `json:"readySeconds"`
+	DeleteSeconds float64       `json:"deleteSeconds"`
+	Failed        bool          `json:"failed"`
+	FailureReason string        `json:"failureReason,omitempty"`
+	totalReady    time.Duration `json:"-"`
+}
+
+// ScaleSpec implements a test that creates ClusterCount workload clusters, Concurrency at a time,
+// to stress-test capc under load, then tears them all down and asserts CloudStack resources are
+// cleaned up.
+func ScaleSpec(ctx context.Context, inputGetter func() ScaleSpecInput) {
+	var (
+		specName           = "scale"
+		input              ScaleSpecInput
+		namespace          *corev1.Namespace
+		cancelWatches      context.CancelFunc
+		clusterNamespaces  []*corev1.Namespace
+		cancelClusterWatch []context.CancelFunc
+		timingsMu          sync.Mutex
+		timings            []*clusterTiming
+	)
+
+	BeforeEach(func() {
+		Expect(ctx).NotTo(BeNil(), "ctx is required for %s spec", specName)
+		input = inputGetter()
+		Expect(input.E2EConfig).ToNot(BeNil(), "Invalid argument. input.E2EConfig can't be nil when calling %s spec", specName)
+		Expect(input.ClusterctlConfigPath).To(BeAnExistingFile(), "Invalid argument. input.ClusterctlConfigPath must be an existing file when calling %s spec", specName)
+		Expect(input.BootstrapClusterProxy).ToNot(BeNil(), "Invalid argument. input.BootstrapClusterProxy can't be nil when calling %s spec", specName)
+		Expect(os.MkdirAll(input.ArtifactFolder, 0750)).To(Succeed(), "Invalid argument. input.ArtifactFolder can't be created for %s spec", specName)
+
+		Expect(input.E2EConfig.Variables).To(HaveKey(KubernetesVersion))
+
+		input.ClusterCount = intFromEnvOrDefault(ScaleClusterCountVar, input.ClusterCount, 10)
+		input.Concurrency = intFromEnvOrDefault(ScaleConcurrencyVar, input.Concurrency, 5)
+		input.ControlPlaneMachineCount = int64(intFromEnvOrDefault(ScaleControlPlaneCountVar, int(input.ControlPlaneMachineCount), 1))
+		input.WorkerMachineCount = int64(intFromEnvOrDefault(ScaleWorkerCountVar, int(input.WorkerMachineCount), 1))
+
+		namespace, cancelWatches = setupSpecNamespace(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder)
+		if input.PostNamespaceCreated != nil && !input.DeployClusterInSeparateNamespaces {
+			input.PostNamespaceCreated(input.BootstrapClusterProxy, namespace.Name)
+		}
+		clusterNamespaces = nil
+		cancelClusterWatch = nil
+		timings = nil
+	})
+
+	It("Should create and delete multiple workload clusters concurrently", func() {
+		logFolder := filepath.Join(input.ArtifactFolder, "clusters", input.BootstrapClusterProxy.GetName())
+
+		By(fmt.Sprintf("Creating %d clusters, %d at a time", input.ClusterCount, input.Concurrency))
+
+		clusterNamespaces = make([]*corev1.Namespace, input.ClusterCount)
+		for i := range clusterNamespaces {
+			if input.DeployClusterInSeparateNamespaces {
+				ns, cancelNsWatch := setupSpecNamespace(ctx, fmt.Sprintf("%s-%d", specName, i), input.BootstrapClusterProxy, input.ArtifactFolder)
+				cancelClusterWatch = append(cancelClusterWatch, cancelNsWatch)
+				if input.PostNamespaceCreated != nil {
+					input.PostNamespaceCreated(input.BootstrapClusterProxy, ns.Name)
+				}
+				clusterNamespaces[i] = ns
+			} else {
+				clusterNamespaces[i] = namespace
+			}
+		}
+
+		jobs := make(chan int, input.ClusterCount)
+		for i := 0; i < input.ClusterCount; i++ {
+			jobs <- i
+		}
+		close(jobs)
+
+		var wg sync.WaitGroup
+		for w := 0; w < input.Concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := range jobs {
+					timing := createWorkloadCluster(ctx, input, clusterNamespaces[i], logFolder, i)
+					timingsMu.Lock()
+					timings = append(timings, timing)
+					timingsMu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		failures := 0
+		for _, t := range timings {
+			if t.Failed {
+				failures++
+			}
+		}
+
+		By(fmt.Sprintf("Tearing down %d clusters, %d at a time", input.ClusterCount, input.Concurrency))
+		deleteJobs := make(chan *clusterTiming, len(timings))
+		for _, t := range timings {
+			deleteJobs <- t
+		}
+		close(deleteJobs)
+
+		var deleteWg sync.WaitGroup
+		for w := 0; w < input.Concurrency; w++ {
+			deleteWg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer deleteWg.Done()
+				for t := range deleteJobs {
+					deleteWorkloadCluster(ctx, input, t)
+				}
+			}()
+		}
+		deleteWg.Wait()
+
+		Expect(writeScaleReport(input.ArtifactFolder, timings)).To(Succeed(), "Failed to write scale-test report")
+
+		By("Asserting CloudStack resources were cleaned up")
+		assertCloudStackResourcesCleanedUp(ctx, input, clusterNamespaces)
+
+		Expect(failures).To(Equal(0), "%d of %d clusters failed to become ready, see scale-report for details", failures, input.ClusterCount)
+
+		By("PASSED!")
+	})
+
+	AfterEach(func() {
+		if input.DeployClusterInSeparateNamespaces {
+			for i, ns := range clusterNamespaces {
+				var cancel context.CancelFunc
+				if i < len(cancelClusterWatch) {
+					cancel = cancelClusterWatch[i]
+				}
+				dumpSpecResourcesAndCleanup(ctx, fmt.Sprintf("%s-%d", specName, i), input.BootstrapClusterProxy, input.ArtifactFolder, ns, cancel, nil, input.E2EConfig.GetIntervals, input.SkipCleanup)
+			}
+		}
+		dumpSpecResourcesAndCleanup(ctx, specName, input.BootstrapClusterProxy, input.ArtifactFolder, namespace, cancelWatches, nil, input.E2EConfig.GetIntervals, input.SkipCleanup)
+	})
+}
+
+// createWorkloadCluster applies the cluster template for cluster index i and records its
+// create/ready latency, without failing the whole suite if this one cluster errors out.
+// CreateSeconds covers configuring and applying the template; ReadySeconds additionally covers
+// waiting for the control plane and worker machines to come up.
+//
+// This runs on a worker-pool goroutine that already has a GinkgoRecover() deferred, so any
+// Gomega failure here is intercepted via InterceptGomegaFailures instead of a bare recover() -
+// a bare recover() would swallow the panic without notifying Ginkgo's spec-tracking state.
+func createWorkloadCluster(ctx context.Context, input ScaleSpecInput, namespace *corev1.Namespace, logFolder string, i int) *clusterTiming {
+	clusterName := fmt.Sprintf("scale-%s-%d", util.RandomString(4), i)
+	timing := &clusterTiming{ClusterName: clusterName, Namespace: namespace.Name}
+
+	start := time.Now()
+
+	failures := InterceptGomegaFailures(func() {
+		workloadClusterTemplate := clusterctl.ConfigCluster(ctx, clusterctl.ConfigClusterInput{
+			KubeconfigPath:           input.BootstrapClusterProxy.GetKubeconfigPath(),
+			ClusterctlConfigPath:     input.ClusterctlConfigPath,
+			Flavor:                   pointer.StringPtrDerefOr(input.Flavor, clusterctl.DefaultFlavor),
+			Namespace:                namespace.Name,
+			ClusterName:              clusterName,
+			KubernetesVersion:        input.E2EConfig.GetVariable(KubernetesVersion),
+			ControlPlaneMachineCount: pointer.Int64Ptr(input.ControlPlaneMachineCount),
+			WorkerMachineCount:       pointer.Int64Ptr(input.WorkerMachineCount),
+			InfrastructureProvider:   clusterctl.DefaultInfrastructureProvider,
+			LogFolder:                logFolder,
+		})
+		Expect(input.BootstrapClusterProxy.Apply(ctx, workloadClusterTemplate)).To(Succeed())
+
+		timing.CreateSeconds = time.Since(start).Seconds()
+
+		cluster := framework.GetClusterByName(ctx, framework.GetClusterByNameInput{
+			Getter:    input.BootstrapClusterProxy.GetClient(),
+			Name:      clusterName,
+			Namespace: namespace.Name,
+		})
+
+		framework.WaitForClusterToProvision(ctx, framework.WaitForClusterToProvisionInput{
+			Getter:  input.BootstrapClusterProxy.GetClient(),
+			Cluster: cluster,
+		}, input.E2EConfig.GetIntervals("scale", "wait-cluster")...)
+
+		framework.DiscoverAndWaitForControlPlaneInitialized(ctx, framework.DiscoverAndWaitForControlPlaneInitializedInput{
+			Lister:  input.BootstrapClusterProxy.GetClient(),
+			Cluster: cluster,
+		}, input.E2EConfig.GetIntervals("scale", "wait-control-plane")...)
+
+		framework.DiscoverAndWaitForMachineDeployments(ctx, framework.DiscoverAndWaitForMachineDeploymentsInput{
+			Lister:  input.BootstrapClusterProxy.GetClient(),
+			Cluster: cluster,
+		}, input.E2EConfig.GetIntervals("scale", "wait-worker-nodes")...)
+	})
+
+	if len(failures) > 0 {
+		timing.Failed = true
+		timing.FailureReason = strings.Join(failures, "; ")
+	}
+
+	timing.ReadySeconds = time.Since(start).Seconds()
+	if timing.Failed && timing.CreateSeconds == 0 {
+		timing.CreateSeconds = timing.ReadySeconds
+	}
+
+	return timing
+}
+
+// deleteWorkloadCluster deletes the cluster recorded by timing and records its delete latency,
+// without letting a failed delete (e.g. framework.GetClusterByName on a cluster that never got
+// created) abort the rest of the teardown. See createWorkloadCluster for why this uses
+// InterceptGomegaFailures rather than a bare recover().
+func deleteWorkloadCluster(ctx context.Context, input ScaleSpecInput, timing *clusterTiming) {
+	start := time.Now()
+
+	failures := InterceptGomegaFailures(func() {
+		cluster := framework.GetClusterByName(ctx, framework.GetClusterByNameInput{
+			Getter:    input.BootstrapClusterProxy.GetClient(),
+			Name:      timing.ClusterName,
+			Namespace: timing.Namespace,
+		})
+		if cluster != nil {
+			framework.DeleteCluster(ctx, framework.DeleteClusterInput{
+				Deleter: input.BootstrapClusterProxy.GetClient(),
+				Cluster: cluster,
+			})
+			framework.WaitForClusterDeleted(ctx, framework.WaitForClusterDeletedInput{
+				Getter:  input.BootstrapClusterProxy.GetClient(),
+				Cluster: cluster,
+			}, input.E2EConfig.GetIntervals("scale", "wait-delete-cluster")...)
+		}
+	})
+
+	if len(failures) > 0 {
+		if timing.FailureReason == "" {
+			timing.FailureReason = "delete failed: " + strings.Join(failures, "; ")
+		}
+		timing.Failed = true
+	}
+
+	timing.DeleteSeconds = time.Since(start).Seconds()
+}
+
+// assertCloudStackResourcesCleanedUp runs the cleanup checks for each distinct namespace used by the
+// scale test. It always asserts that the namespace has no Pods left in the management cluster. The
+// CloudStack-side checks (networks, isolated networks, affinity groups) are the ones supplied by the
+// caller via AssertResourcesCleanedUp, since this package has no CloudStack client of its own; when
+// that hook is nil, no CloudStack resources are checked.
+func assertCloudStackResourcesCleanedUp(ctx context.Context, input ScaleSpecInput, namespaces []*corev1.Namespace) {
+	dedupedNamespaces := map[string]*corev1.Namespace{}
+	for _, ns := range namespaces {
+		dedupedNamespaces[ns.Name] = ns
+	}
+
+	for _, ns := range dedupedNamespaces {
+		Eventually(func() ([]corev1.Pod, error) {
+			podList := &corev1.PodList{}
+			err := input.BootstrapClusterProxy.GetClient().List(ctx, podList, client.InNamespace(ns.Name))
+			return podList.Items, err
+		}, input.E2EConfig.GetIntervals("scale", "wait-delete-cluster")...).Should(BeEmpty(), "Expected namespace %s to have no leftover pods after cleanup", ns.Name)
+
+		if input.AssertResourcesCleanedUp != nil {
+			input.AssertResourcesCleanedUp(input.BootstrapClusterProxy, ns.Name)
+		}
+	}
+}
+
+// writeScaleReport writes the per-cluster timings collected during ScaleSpec to
+// ArtifactFolder/scale-report.json and ArtifactFolder/scale-report.csv.
+func writeScaleReport(artifactFolder string, timings []*clusterTiming) error {
+	jsonPath := filepath.Join(artifactFolder, "scale-report.json")
+	jsonData, err := json.MarshalIndent(timings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal scale report: %w", err)
+	}
+	if err := os.WriteFile(jsonPath, jsonData, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", jsonPath, err)
+	}
+
+	csvPath := filepath.Join(artifactFolder, "scale-report.csv")
+	csvFile, err := os.Create(csvPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", csvPath, err)
+	}
+	defer csvFile.Close()
+
+	w := csv.NewWriter(csvFile)
+	defer w.Flush()
+	if err := w.Write([]string{"clusterName", "namespace", "createSeconds", "readySeconds", "deleteSeconds", "failed", "failureReason"}); err != nil {
+		return err
+	}
+	for _, t := range timings {
+		if err := w.Write([]string{
+			t.ClusterName,
+			t.Namespace,
+			strconv.FormatFloat(t.CreateSeconds, 'f', 2, 64),
+			strconv.FormatFloat(t.ReadySeconds, 'f', 2, 64),
+			strconv.FormatFloat(t.DeleteSeconds, 'f', 2, 64),
+			strconv.FormatBool(t.Failed),
+			t.FailureReason,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intFromEnvOrDefault returns configured if it is non-zero, else the value of the named env var
+// parsed as an int, else def.
+func intFromEnvOrDefault(envVar string, configured int, def int) int {
+	if configured != 0 {
+		return configured
+	}
+	if v := os.Getenv(envVar); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}